@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json/v2"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestJob(id string) *job {
+	return &job{id: id, state: JobStateNew}
+}
+
+// recordingWriter is a responseWriter backend that just appends every sent
+// response, so tests can inspect what runJob reported without a real
+// transport.
+type recordingWriter struct {
+	mu    sync.Mutex
+	resps []CommandResponse
+}
+
+func (r *recordingWriter) rw() *responseWriter {
+	return &responseWriter{encode: func(resp CommandResponse) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.resps = append(r.resps, resp)
+		return nil
+	}}
+}
+
+func jobState(j *job) (JobState, int, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state, j.exitCode, j.truncated
+}
+
+func TestRunJobLifecycleSuccess(t *testing.T) {
+	j := newTestJob("lifecycle-success")
+	rec := &recordingWriter{}
+
+	runJob(j, CommandRequest{Program: "true"}, rec.rw())
+
+	state, exitCode, _ := jobState(j)
+	if state != JobStateSuccess {
+		t.Fatalf("state = %q, want %q", state, JobStateSuccess)
+	}
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0", exitCode)
+	}
+}
+
+func TestRunJobLifecycleNonzeroExitIsStillSuccess(t *testing.T) {
+	j := newTestJob("lifecycle-nonzero")
+	rec := &recordingWriter{}
+
+	runJob(j, CommandRequest{Program: "false"}, rec.rw())
+
+	// State tracks whether xuehua itself managed to run the child; the
+	// child's own exit code is reported separately via ExitCode. A
+	// nonzero exit is a perfectly normal completed job.
+	state, exitCode, _ := jobState(j)
+	if state != JobStateSuccess {
+		t.Fatalf("state = %q, want %q", state, JobStateSuccess)
+	}
+	if exitCode == 0 {
+		t.Fatal("exit code = 0, want nonzero")
+	}
+}
+
+func TestRunJobHonorsCancelBeforeStart(t *testing.T) {
+	j := newTestJob("cancel-before-start")
+	rec := &recordingWriter{}
+
+	// Simulate a cancel landing in the window handleCancel and runJob's
+	// canceled flag exist to close: before cmd.Start has produced a
+	// process for Kill to target.
+	j.mu.Lock()
+	j.canceled = true
+	j.mu.Unlock()
+
+	start := time.Now()
+	runJob(j, CommandRequest{Program: "sleep", Args: []string{"5"}}, rec.rw())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("job ran for %s, want it killed almost immediately", elapsed)
+	}
+}
+
+// TestCommandRequestRoundTripsStdin guards against the `format` struct tag
+// option landing anywhere but last: encoding/json/v2 rejects the whole
+// struct at decode time if it doesn't, and a Go-literal CommandRequest (as
+// every other test in this file builds) can't catch that since it never
+// goes through Marshal/Unmarshal.
+func TestCommandRequestRoundTripsStdin(t *testing.T) {
+	want := CommandRequest{Command: CommandExec, Program: "cat", Stdin: []byte("hello")}
+
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var got CommandRequest
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !bytes.Equal(got.Stdin, want.Stdin) {
+		t.Fatalf("Stdin = %q, want %q", got.Stdin, want.Stdin)
+	}
+
+	// The empty-Stdin case must also decode cleanly: it's the one every
+	// plain exec request without stdin takes.
+	plain := CommandRequest{Command: CommandExec, Program: "true"}
+	data, err = json.Marshal(plain)
+	if err != nil {
+		t.Fatalf("Marshal (no stdin): %v", err)
+	}
+	var gotPlain CommandRequest
+	if err := json.Unmarshal(data, &gotPlain); err != nil {
+		t.Fatalf("Unmarshal (no stdin): %v", err)
+	}
+}
+
+func TestRunJobTruncatesOversizedOutput(t *testing.T) {
+	j := newTestJob("truncate")
+	rec := &recordingWriter{}
+
+	runJob(j, CommandRequest{
+		Program:        "sh",
+		Args:           []string{"-c", "printf '0123456789'"},
+		MaxStdoutBytes: 4,
+	}, rec.rw())
+
+	_, _, truncated := jobState(j)
+	if !truncated {
+		t.Fatal("truncated = false, want true")
+	}
+
+	var stdout []byte
+	rec.mu.Lock()
+	for _, resp := range rec.resps {
+		if resp.Chunk != nil && resp.Chunk.Stream == "stdout" {
+			stdout = append(stdout, resp.Chunk.Data...)
+		}
+	}
+	rec.mu.Unlock()
+	if len(stdout) != 4 {
+		t.Fatalf("stdout bytes sent = %d, want 4", len(stdout))
+	}
+}
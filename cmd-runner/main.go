@@ -1,88 +1,534 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json/jsontext"
-	"encoding/json/v2"
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"sync"
+	"time"
+)
+
+// Command discriminates the kind of request on the wire. An empty Command
+// is treated as "exec", so requests without a "command" field still run;
+// their responses use the streamed job format (chunk frames and info
+// messages), not a single response carrying the whole output.
+type Command string
+
+const (
+	CommandExec   Command = "exec"
+	CommandCancel Command = "cancel"
+	CommandStatus Command = "status"
+	CommandList   Command = "list"
+	CommandStdin  Command = "stdin"
 )
 
 type CommandRequest struct {
-	Program     string   `json:"program"`
-	Args        []string `json:"args"`
-	WorkingDir  string   `json:"working_dir"`
-	Environment []string `json:"environment"`
+	Command     Command  `json:"command,omitempty"`
+	JobID       string   `json:"job_id,omitempty"`
+	Program     string   `json:"program,omitempty"`
+	Args        []string `json:"args,omitempty"`
+	WorkingDir  string   `json:"working_dir,omitempty"`
+	Environment []string `json:"environment,omitempty"`
+
+	// Stdin, if set on an exec request, is written to the child's stdin and
+	// the pipe is closed before the process is waited on (one-shot mode).
+	// Omit it to leave stdin open for streaming "stdin" command frames
+	// instead.
+	Stdin []byte `json:"stdin,omitempty,format:array"`
+
+	// Data and EOF are used by "stdin" command frames to feed a running
+	// job's stdin after it has started.
+	Data []byte `json:"data,omitempty,format:array"`
+	EOF  bool   `json:"eof,omitempty"`
+
+	// TimeoutMS kills the process if it hasn't exited within the given
+	// number of milliseconds. Zero means no timeout.
+	TimeoutMS int64 `json:"timeout_ms,omitempty"`
+
+	// MaxStdoutBytes and MaxStderrBytes cap how much output is streamed
+	// back per channel; further bytes are discarded (not buffered) and
+	// CommandResponseInfo.Truncated is set. Zero means no cap.
+	MaxStdoutBytes int64 `json:"max_stdout_bytes,omitempty"`
+	MaxStderrBytes int64 `json:"max_stderr_bytes,omitempty"`
+
+	// Rlimits applies POSIX resource limits to the child before it execs.
+	// Only supported on Linux; see rlimit_linux.go.
+	Rlimits map[string]Rlimit `json:"rlimits,omitempty"`
 }
 
+type Rlimit struct {
+	Cur uint64 `json:"cur"`
+	Max uint64 `json:"max,omitempty"`
+}
+
+type CommandResponseChunk struct {
+	Stream string `json:"stream"`
+	Data   []byte `json:"data,format:array"`
+}
+
+type JobState string
+
+const (
+	JobStateNew     JobState = "new"
+	JobStateRunning JobState = "running"
+	JobStateSuccess JobState = "success"
+	JobStateFailure JobState = "failure"
+)
+
 type CommandResponseInfo struct {
-	ExitCode int    `json:"exit_code"`
-	Stdout   []byte `json:"stdout,format:array"`
-	Stderr   []byte `json:"stderr,format:array"`
+	State     JobState `json:"state"`
+	ExitCode  int      `json:"exit_code"`
+	Truncated bool     `json:"truncated,omitempty"`
+}
+
+type JobSummary struct {
+	JobID string   `json:"job_id"`
+	State JobState `json:"state"`
 }
 
 type CommandResponse struct {
-	Error *string              `json:"error,omitempty"`
-	Info  *CommandResponseInfo `json:"info,omitempty"`
+	JobID string                `json:"job_id,omitempty"`
+	Error *string               `json:"error,omitempty"`
+	Chunk *CommandResponseChunk `json:"chunk,omitempty"`
+	Info  *CommandResponseInfo  `json:"info,omitempty"`
+	Jobs  []JobSummary          `json:"jobs,omitempty"`
 }
 
-func handleLine(decoder *jsontext.Decoder) (*CommandResponseInfo, error) {
-	var req CommandRequest
-	err := json.UnmarshalDecode(decoder, &req)
-	if err != nil {
-		return nil, fmt.Errorf("error deserializing request: %w", err)
+// responseWriter serializes writes to a transport's underlying connection:
+// jobs stream their output and completion concurrently from their own
+// goroutines, and the transport's encoder is not safe for concurrent use.
+// encode does the actual wire-format write and is supplied by the
+// transport (see transport.go).
+type responseWriter struct {
+	mu     sync.Mutex
+	encode func(CommandResponse) error
+}
+
+func (w *responseWriter) send(resp CommandResponse) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.encode(resp)
+}
+
+// job tracks one spawned process so that later cancel/status/list requests
+// can refer back to it by ID while it's still running.
+type job struct {
+	id string
+
+	mu        sync.Mutex
+	state     JobState
+	cmd       *exec.Cmd
+	exitCode  int
+	truncated bool
+	canceled  bool
+
+	// stdinMu guards stdin separately from mu so that writing a stdin frame
+	// never blocks a concurrent status/list/cancel request.
+	stdinMu sync.Mutex
+	stdin   io.WriteCloser
+}
+
+// writeStdin feeds data to the job's stdin pipe, closing it if eof is set.
+// It reports an error if the job's stdin has already been closed.
+func (j *job) writeStdin(data []byte, eof bool) error {
+	j.stdinMu.Lock()
+	defer j.stdinMu.Unlock()
+
+	if j.stdin == nil {
+		return fmt.Errorf("job %q has no open stdin", j.id)
+	}
+	if len(data) > 0 {
+		if _, err := j.stdin.Write(data); err != nil {
+			return fmt.Errorf("could not write to job stdin: %w", err)
+		}
+	}
+	if eof {
+		err := j.stdin.Close()
+		j.stdin = nil
+		if err != nil {
+			return fmt.Errorf("could not close job stdin: %w", err)
+		}
 	}
+	return nil
+}
+
+func (j *job) summary() JobSummary {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return JobSummary{JobID: j.id, State: j.state}
+}
+
+func (j *job) info() *CommandResponseInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return &CommandResponseInfo{State: j.state, ExitCode: j.exitCode, Truncated: j.truncated}
+}
+
+type jobManager struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func newJobManager() *jobManager {
+	return &jobManager{jobs: make(map[string]*job)}
+}
+
+func (m *jobManager) add(j *job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[j.id] = j
+}
+
+func (m *jobManager) get(id string) (*job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	return j, ok
+}
+
+func (m *jobManager) list() []JobSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	summaries := make([]JobSummary, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		summaries = append(summaries, j.summary())
+	}
+	return summaries
+}
 
-	cmd := exec.Command(req.Program, req.Args...)
+// newJobID generates a server-side correlation ID for requests that don't
+// supply their own job_id.
+func newJobID() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", fmt.Errorf("could not generate job id: %w", err)
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// streamPipe copies r into framed chunk responses until EOF, recording the
+// first error (from either the read or the send) into errOut. If maxBytes
+// is positive, at most that many bytes are sent on the wire; the pipe is
+// still drained so the child is never blocked on a full output buffer, and
+// *truncated is set once the cap is hit.
+func streamPipe(rw *responseWriter, id, stream string, r io.Reader, maxBytes int64, truncated *bool, truncatedMu *sync.Mutex, wg *sync.WaitGroup, errOut *error) {
+	defer wg.Done()
+
+	reader := bufio.NewReader(r)
+	buf := make([]byte, 32*1024)
+	var sent int64
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			chunk := buf[:n]
+			if maxBytes > 0 {
+				if sent >= maxBytes {
+					chunk = nil
+				} else if remaining := maxBytes - sent; int64(len(chunk)) > remaining {
+					chunk = chunk[:remaining]
+				}
+				if len(chunk) < n {
+					truncatedMu.Lock()
+					*truncated = true
+					truncatedMu.Unlock()
+				}
+			}
+			if len(chunk) > 0 {
+				sent += int64(len(chunk))
+				data := append([]byte(nil), chunk...)
+				sendErr := rw.send(CommandResponse{
+					JobID: id,
+					Chunk: &CommandResponseChunk{Stream: stream, Data: data},
+				})
+				if sendErr != nil && *errOut == nil {
+					*errOut = sendErr
+				}
+			}
+		}
+		if err != nil {
+			if err != io.EOF && *errOut == nil {
+				*errOut = err
+			}
+			return
+		}
+	}
+}
+
+// runJob starts req's process, streams its output, and reports the final
+// state once it exits. It runs on its own goroutine so that exec requests
+// never block the main request loop from dispatching further work.
+func runJob(j *job, req CommandRequest, rw *responseWriter) {
+	ctx := context.Background()
+	cancel := func() {}
+	if req.TimeoutMS > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.TimeoutMS)*time.Millisecond)
+	}
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, req.Program, req.Args...)
 	cmd.Env = append(cmd.Env, req.Environment...)
 	cmd.Dir = req.WorkingDir
 
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	fail := func(err error) {
+		j.mu.Lock()
+		j.state = JobStateFailure
+		j.mu.Unlock()
+		errString := err.Error()
+		rw.send(CommandResponse{JobID: j.id, Error: &errString})
+	}
 
-	err = cmd.Run()
-	exitCode := 0
-	stdoutBytes := stdout.Bytes()
-	stderrBytes := stderr.Bytes()
+	var rlimitStatus *os.File
+	var err error
+	if len(req.Rlimits) > 0 {
+		rlimitStatus, err = applyRlimits(cmd, req.Rlimits)
+		if err != nil {
+			fail(err)
+			return
+		}
+		// Covers every return between here and the explicit close below
+		// (pipe-setup or Start failures): without it, a job that never
+		// starts leaks both ends of the status pipe.
+		defer func() {
+			rlimitStatus.Close()
+			for _, f := range cmd.ExtraFiles {
+				f.Close()
+			}
+		}()
+	}
 
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		fail(fmt.Errorf("could not open stdin pipe: %w", err))
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		fail(fmt.Errorf("could not open stdout pipe: %w", err))
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		fail(fmt.Errorf("could not open stderr pipe: %w", err))
+		return
+	}
+
+	j.mu.Lock()
+	j.cmd = cmd
+	j.mu.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		fail(fmt.Errorf("command failed to start: %s", err))
+		return
+	}
+
+	if rlimitStatus != nil {
+		// Our copy of the write end must be closed too, or the read below
+		// blocks forever waiting for every copy of the pipe to close.
+		for _, f := range cmd.ExtraFiles {
+			f.Close()
+		}
+		msg, readErr := io.ReadAll(rlimitStatus)
+		rlimitStatus.Close()
+		if readErr == nil && len(msg) > 0 {
+			// The helper reported a failure (e.g. setrlimit rejected by the
+			// kernel) before it ever reached the target program; the
+			// process that did start is the helper, not req.Program, so
+			// this is an infra-level failure, not the child's real exit.
+			cmd.Process.Kill()
+			cmd.Wait() // reap; Start succeeded, so a child exists to collect
+			fail(fmt.Errorf("rlimit helper: %s", msg))
+			return
+		}
+	}
+
+	if req.Stdin != nil {
+		// One-shot mode: feed the initial payload and close immediately so
+		// the child observes EOF right away.
+		if _, err := stdin.Write(req.Stdin); err != nil {
+			// The child has already started; a write failure (e.g. EPIPE
+			// because it exited before we finished writing) still leaves it
+			// to reap, or it becomes a zombie for the life of the server.
+			cmd.Wait()
+			fail(fmt.Errorf("could not write stdin: %w", err))
+			return
+		}
+		stdin.Close()
+	} else {
+		// Leave stdin open for streaming "stdin" command frames; a later
+		// frame with eof:true (or job completion) closes it. This must
+		// happen before the state flips to Running below, so that a client
+		// polling status and seeing "running" is guaranteed the pipe is
+		// already wired before it sends a stdin frame.
+		j.stdinMu.Lock()
+		j.stdin = stdin
+		j.stdinMu.Unlock()
+	}
+
+	j.mu.Lock()
+	j.state = JobStateRunning
+	canceledAlready := j.canceled
+	j.mu.Unlock()
+
+	if canceledAlready {
+		// A cancel landed before the process existed to kill; honor it now
+		// that Start has actually produced one, instead of letting it run.
+		if err := cmd.Process.Kill(); err != nil {
+			errString := fmt.Sprintf("could not honor cancel: %s", err)
+			rw.send(CommandResponse{JobID: j.id, Error: &errString})
+		}
+	}
+
+	var wg sync.WaitGroup
+	var streamErr error
+	var truncatedMu sync.Mutex
+	var truncated bool
+	wg.Add(2)
+	go streamPipe(rw, j.id, "stdout", stdout, req.MaxStdoutBytes, &truncated, &truncatedMu, &wg, &streamErr)
+	go streamPipe(rw, j.id, "stderr", stderr, req.MaxStderrBytes, &truncated, &truncatedMu, &wg, &streamErr)
+	wg.Wait()
+
+	defer func() {
+		j.stdinMu.Lock()
+		if j.stdin != nil {
+			j.stdin.Close()
+			j.stdin = nil
+		}
+		j.stdinMu.Unlock()
+	}()
+
+	err = cmd.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		fail(errors.New("timeout"))
+		return
+	}
+	exitCode := 0
 	if err != nil {
 		var exitError *exec.ExitError
 		if errors.As(err, &exitError) {
 			exitCode = exitError.ExitCode()
 		} else {
-			return nil, fmt.Errorf("command failed: %s", err)
+			fail(fmt.Errorf("command failed: %s", err))
+			return
 		}
 	}
+	if streamErr != nil {
+		fail(fmt.Errorf("error streaming command output: %w", streamErr))
+		return
+	}
 
-	return &CommandResponseInfo{
-		ExitCode: exitCode,
-		Stdout:   stdoutBytes,
-		Stderr:   stderrBytes,
-	}, nil
-}
-
-func main() {
-	decoder := jsontext.NewDecoder(os.Stdin)
-	encoder := jsontext.NewEncoder(os.Stdout)
+	j.mu.Lock()
+	j.state = JobStateSuccess
+	j.exitCode = exitCode
+	j.truncated = truncated
+	j.mu.Unlock()
 
-	for {
-		resp := CommandResponse{}
+	rw.send(CommandResponse{
+		JobID: j.id,
+		Info:  &CommandResponseInfo{State: JobStateSuccess, ExitCode: exitCode, Truncated: truncated},
+	})
+}
 
-		info, err := handleLine(decoder)
+func dispatchExec(jm *jobManager, rw *responseWriter, req CommandRequest) error {
+	id := req.JobID
+	if id == "" {
+		generated, err := newJobID()
 		if err != nil {
-			decoder.Reset(os.Stdin)
-			errString := err.Error()
-			resp.Error = &errString
-		} else {
-			resp.Info = info
+			return err
 		}
+		id = generated
+	}
 
-		err = json.MarshalEncode(encoder, resp)
-		if err != nil {
-			panic(fmt.Sprint("could not encode response", err))
+	j := &job{id: id, state: JobStateNew}
+	jm.add(j)
+
+	if err := rw.send(CommandResponse{JobID: id, Info: j.info()}); err != nil {
+		return err
+	}
+
+	go runJob(j, req, rw)
+	return nil
+}
+
+func handleCancel(jm *jobManager, rw *responseWriter, req CommandRequest) error {
+	j, ok := jm.get(req.JobID)
+	if !ok {
+		errString := fmt.Sprintf("unknown job %q", req.JobID)
+		return rw.send(CommandResponse{JobID: req.JobID, Error: &errString})
+	}
+
+	j.mu.Lock()
+	j.canceled = true
+	cmd := j.cmd
+	j.mu.Unlock()
+
+	// If the process hasn't been started yet (runJob hasn't reached
+	// cmd.Start), there's nothing to kill yet; the canceled flag set above
+	// makes runJob kill it the moment Start succeeds instead.
+	if cmd != nil && cmd.Process != nil {
+		if err := cmd.Process.Kill(); err != nil {
+			errString := fmt.Sprintf("could not cancel job: %s", err)
+			return rw.send(CommandResponse{JobID: req.JobID, Error: &errString})
 		}
 	}
+
+	return rw.send(CommandResponse{JobID: req.JobID, Info: j.info()})
+}
+
+func handleStatus(jm *jobManager, rw *responseWriter, req CommandRequest) error {
+	j, ok := jm.get(req.JobID)
+	if !ok {
+		errString := fmt.Sprintf("unknown job %q", req.JobID)
+		return rw.send(CommandResponse{JobID: req.JobID, Error: &errString})
+	}
+	return rw.send(CommandResponse{JobID: req.JobID, Info: j.info()})
+}
+
+func handleList(jm *jobManager, rw *responseWriter) error {
+	return rw.send(CommandResponse{Jobs: jm.list()})
+}
+
+func handleStdin(jm *jobManager, rw *responseWriter, req CommandRequest) error {
+	j, ok := jm.get(req.JobID)
+	if !ok {
+		errString := fmt.Sprintf("unknown job %q", req.JobID)
+		return rw.send(CommandResponse{JobID: req.JobID, Error: &errString})
+	}
+
+	if err := j.writeStdin(req.Data, req.EOF); err != nil {
+		errString := err.Error()
+		return rw.send(CommandResponse{JobID: req.JobID, Error: &errString})
+	}
+	return nil
+}
+
+// handleRequest decodes one request via decode and dispatches it. decode is
+// supplied by the transport (see transport.go) and returns io.EOF when the
+// connection ends cleanly between requests.
+func handleRequest(decode func() (CommandRequest, error), rw *responseWriter, jm *jobManager) error {
+	req, err := decode()
+	if err != nil {
+		return fmt.Errorf("error deserializing request: %w", err)
+	}
+
+	switch req.Command {
+	case CommandExec, "":
+		return dispatchExec(jm, rw, req)
+	case CommandCancel:
+		return handleCancel(jm, rw, req)
+	case CommandStatus:
+		return handleStatus(jm, rw, req)
+	case CommandList:
+		return handleList(jm, rw)
+	case CommandStdin:
+		return handleStdin(jm, rw, req)
+	default:
+		errString := fmt.Sprintf("unknown command %q", req.Command)
+		return rw.send(CommandResponse{JobID: req.JobID, Error: &errString})
+	}
 }
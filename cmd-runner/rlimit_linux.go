@@ -0,0 +1,123 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json/v2"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// rlimitHelperFlag marks a re-exec of this same binary whose only job is to
+// apply the requested rlimits to itself and then exec into the real target
+// program, so the limits are already in effect before the target's first
+// instruction runs. Go's os/exec has no direct pre-exec hook, and setrlimit
+// only ever affects the calling process, hence the re-exec.
+const rlimitHelperFlag = "-xuehua-rlimit-helper"
+
+// rlimitStatusFD is the file descriptor (inherited via cmd.ExtraFiles) the
+// helper uses to report whether it actually made it into the target
+// program. The child's real exit code is not trustworthy for this: a
+// setrlimit failure is reported by the helper process exiting nonzero,
+// which is indistinguishable on its own from the target itself exiting
+// with that same code.
+const rlimitStatusFD = 3
+
+// rlimitNproc and rlimitMemlock are RLIMIT_NPROC and RLIMIT_MEMLOCK from
+// asm-generic/resource.h. The syscall package doesn't define either
+// constant (they're Linux extensions, not POSIX, so x/sys/unix has them
+// but the standard syscall package doesn't), and this tree has no
+// dependency on x/sys to pull them in from there instead.
+const (
+	rlimitNproc   = 6
+	rlimitMemlock = 8
+)
+
+var rlimitResources = map[string]int{
+	"cpu":     syscall.RLIMIT_CPU,
+	"fsize":   syscall.RLIMIT_FSIZE,
+	"data":    syscall.RLIMIT_DATA,
+	"stack":   syscall.RLIMIT_STACK,
+	"core":    syscall.RLIMIT_CORE,
+	"nofile":  syscall.RLIMIT_NOFILE,
+	"as":      syscall.RLIMIT_AS,
+	"nproc":   rlimitNproc,
+	"memlock": rlimitMemlock,
+}
+
+// applyRlimits rewrites cmd to run as: self -xuehua-rlimit-helper <limits>
+// <resolved path> <original argv...>, deferring the actual program to
+// maybeRunRlimitHelper. It returns the read end of a status pipe: the
+// caller must close its own write-end copy after Start and then read from
+// it (see rlimitStatus in main.go) to learn whether the helper actually
+// reached the target program.
+func applyRlimits(cmd *exec.Cmd, limits map[string]Rlimit) (*os.File, error) {
+	for name := range limits {
+		if _, ok := rlimitResources[name]; !ok {
+			return nil, fmt.Errorf("unknown rlimit %q", name)
+		}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve self for rlimit helper: %w", err)
+	}
+	encoded, err := json.Marshal(limits)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode rlimits: %w", err)
+	}
+
+	statusR, statusW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not open rlimit status pipe: %w", err)
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, statusW)
+
+	cmd.Args = append([]string{self, rlimitHelperFlag, string(encoded), cmd.Path}, cmd.Args...)
+	cmd.Path = self
+	return statusR, nil
+}
+
+// maybeRunRlimitHelper runs this process as the rlimit helper and never
+// returns if invoked that way: it applies the encoded limits to itself and
+// execs into the real target, replacing this process image. The status
+// pipe is closed with no data written on success, which the exec into the
+// target does implicitly (it's marked close-on-exec right before the
+// attempt); any write to it means the helper failed before getting there.
+func maybeRunRlimitHelper() {
+	if len(os.Args) < 5 || os.Args[1] != rlimitHelperFlag {
+		return
+	}
+
+	status := os.NewFile(rlimitStatusFD, "rlimit-status")
+	fail := func(err error) {
+		fmt.Fprintf(status, "ERR:%s", err)
+		status.Close()
+		os.Exit(1)
+	}
+
+	var limits map[string]Rlimit
+	if err := json.Unmarshal([]byte(os.Args[2]), &limits); err != nil {
+		fail(fmt.Errorf("decode limits: %w", err))
+	}
+	for name, lim := range limits {
+		rl := syscall.Rlimit{Cur: lim.Cur, Max: lim.Max}
+		if rl.Max == 0 {
+			rl.Max = rl.Cur
+		}
+		if err := syscall.Setrlimit(rlimitResources[name], &rl); err != nil {
+			fail(fmt.Errorf("setrlimit %q: %w", name, err))
+		}
+	}
+
+	// Limits are in effect; close the status fd on exec instead of right
+	// now, so a failing Exec below can still report itself through it.
+	syscall.CloseOnExec(rlimitStatusFD)
+
+	target := os.Args[3]
+	if err := syscall.Exec(target, os.Args[4:], os.Environ()); err != nil {
+		fail(fmt.Errorf("exec %s: %w", target, err))
+	}
+}
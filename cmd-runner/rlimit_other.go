@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func applyRlimits(cmd *exec.Cmd, limits map[string]Rlimit) (*os.File, error) {
+	return nil, fmt.Errorf("rlimits are only supported on linux")
+}
+
+func maybeRunRlimitHelper() {}
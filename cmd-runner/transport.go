@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json/jsontext"
+	"encoding/json/v2"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// Transport owns how CommandRequest/CommandResponse values cross the wire.
+// Serve runs until the transport's connection(s) are exhausted or an
+// unrecoverable error occurs.
+type Transport interface {
+	Serve(jm *jobManager) error
+}
+
+// newTransport parses the -transport flag value into a Transport.
+func newTransport(spec string) (Transport, error) {
+	switch {
+	case spec == "stdio":
+		return stdioTransport{}, nil
+	case spec == "framed":
+		return framedTransport{}, nil
+	case strings.HasPrefix(spec, "unix:"):
+		return unixTransport{path: strings.TrimPrefix(spec, "unix:")}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q (want stdio, framed, or unix:/path)", spec)
+	}
+}
+
+// serveStreamConn runs the request/response loop for a continuous,
+// self-delimiting JSON stream decoded and encoded with jsontext: requests
+// need nothing but optional whitespace between them, and each response is
+// followed by a newline. Used by both the stdio transport and each
+// connection accepted by the Unix-socket transport.
+func serveStreamConn(r io.Reader, w io.Writer, jm *jobManager) {
+	decoder := jsontext.NewDecoder(r)
+	encoder := jsontext.NewEncoder(w)
+	rw := &responseWriter{encode: func(resp CommandResponse) error {
+		return json.MarshalEncode(encoder, resp)
+	}}
+	decode := func() (CommandRequest, error) {
+		var req CommandRequest
+		err := json.UnmarshalDecode(decoder, &req)
+		return req, err
+	}
+
+	for {
+		err := handleRequest(decode, rw, jm)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			// Reset clears the decoder's error state so the loop can go on,
+			// but it also drops whatever the decoder had already buffered
+			// from r, so after a malformed value decoding may resume in the
+			// middle of a later value (the framed transport has no such gap).
+			decoder.Reset(r)
+			errString := err.Error()
+			if rw.send(CommandResponse{Error: &errString}) != nil {
+				return
+			}
+		}
+	}
+}
+
+// stdioTransport is the original newline-delimited-JSON-over-stdio mode.
+type stdioTransport struct{}
+
+func (stdioTransport) Serve(jm *jobManager) error {
+	serveStreamConn(os.Stdin, os.Stdout, jm)
+	return nil
+}
+
+// unixTransport listens on a Unix-domain socket and serves each accepted
+// connection concurrently, each with its own decoder/encoder pair.
+type unixTransport struct {
+	path string
+}
+
+func (t unixTransport) Serve(jm *jobManager) error {
+	os.Remove(t.path) // clear a stale socket left behind by a prior run
+	ln, err := net.Listen("unix", t.path)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %w", t.path, err)
+	}
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("accept failed: %w", err)
+		}
+		go func() {
+			defer conn.Close()
+			serveStreamConn(conn, conn, jm)
+		}()
+	}
+}
+
+// framedTransport frames each request/response as a 4-byte big-endian
+// length prefix followed by that many bytes of JSON. Unlike the stdio
+// transport, a malformed payload never desyncs the stream: the frame
+// boundary is explicit, so recovery doesn't depend on where the decoder
+// happened to give up parsing.
+type framedTransport struct{}
+
+func (framedTransport) Serve(jm *jobManager) error {
+	r := bufio.NewReader(os.Stdin)
+	rw := &responseWriter{encode: func(resp CommandResponse) error {
+		return writeFrame(os.Stdout, resp)
+	}}
+	decode := func() (CommandRequest, error) {
+		return readFrame(r)
+	}
+
+	for {
+		err := handleRequest(decode, rw, jm)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			errString := err.Error()
+			if rw.send(CommandResponse{Error: &errString}) != nil {
+				return nil
+			}
+		}
+	}
+}
+
+func writeFrame(w io.Writer, resp CommandResponse) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("could not encode response: %w", err)
+	}
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// maxFrameBytes bounds a single frame's declared length so a bogus or
+// hostile length prefix can't make the server allocate an unbounded buffer
+// before a single byte of payload has even arrived.
+const maxFrameBytes = 64 * 1024 * 1024
+
+func readFrame(r *bufio.Reader) (CommandRequest, error) {
+	var req CommandRequest
+
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return req, err // io.EOF here means the stream ended cleanly
+	}
+
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n > maxFrameBytes {
+		// Drain the oversized payload (without buffering all of it at
+		// once) so the stream stays framed for the next call instead of
+		// desyncing on whatever bytes we left behind.
+		if _, err := io.CopyN(io.Discard, r, int64(n)); err != nil {
+			return req, fmt.Errorf("frame of %d bytes exceeds max of %d, and draining it failed: %w", n, maxFrameBytes, err)
+		}
+		return req, fmt.Errorf("frame of %d bytes exceeds max of %d", n, maxFrameBytes)
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return req, fmt.Errorf("short frame: %w", err)
+	}
+
+	err := json.Unmarshal(data, &req)
+	return req, err
+}
+
+func main() {
+	maybeRunRlimitHelper()
+
+	transportFlag := flag.String("transport", "stdio", "transport to use: stdio, framed, or unix:/path/to/socket")
+	flag.Parse()
+
+	transport, err := newTransport(*transportFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	jm := newJobManager()
+	if err := transport.Serve(jm); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}